@@ -0,0 +1,233 @@
+// Copyright 2013 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lb
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// HealthCheckOptions configures the active health probe a HealthChecker
+// runs against every backend, and the thresholds both it and passive
+// failure tracking use to flip a backend's health state.
+type HealthCheckOptions struct {
+	// Path is requested on each backend to probe its health. Defaults to "/".
+	Path string
+	// ExpectedStatus is the status code a probe must return to count as
+	// healthy. Defaults to http.StatusOK.
+	ExpectedStatus int
+	// Timeout bounds each individual probe request. Defaults to 2s.
+	Timeout time.Duration
+	// Interval is the time between probe rounds. Defaults to 10s.
+	Interval time.Duration
+	// UnhealthyThreshold is the number of consecutive failures (probe or
+	// passive) required to mark a healthy backend unhealthy. Defaults to 2.
+	UnhealthyThreshold int
+	// HealthyThreshold is the number of consecutive successes required to
+	// mark an unhealthy backend healthy again. Defaults to 2.
+	HealthyThreshold int
+}
+
+func (o HealthCheckOptions) withDefaults() HealthCheckOptions {
+	if o.Path == "" {
+		o.Path = "/"
+	}
+	if o.ExpectedStatus == 0 {
+		o.ExpectedStatus = http.StatusOK
+	}
+	if o.Timeout <= 0 {
+		o.Timeout = 2 * time.Second
+	}
+	if o.Interval <= 0 {
+		o.Interval = 10 * time.Second
+	}
+	if o.UnhealthyThreshold <= 0 {
+		o.UnhealthyThreshold = 2
+	}
+	if o.HealthyThreshold <= 0 {
+		o.HealthyThreshold = 2
+	}
+	return o
+}
+
+// HealthChecker actively probes a LoadBalancer's backends on an interval
+// and also receives passive reports from Backend.handle and
+// httputil.ReverseProxy.ErrorHandler, evicting and re-admitting backends
+// from selection as their health changes.
+type HealthChecker struct {
+	lb     *LoadBalancer
+	opts   HealthCheckOptions
+	client http.Client
+	stop   chan struct{}
+}
+
+func newHealthChecker(lb *LoadBalancer, opts HealthCheckOptions) *HealthChecker {
+	opts = opts.withDefaults()
+	return &HealthChecker{
+		lb:     lb,
+		opts:   opts,
+		client: http.Client{Timeout: opts.Timeout},
+		stop:   make(chan struct{}),
+	}
+}
+
+// run probes every backend currently registered with h.lb on every tick,
+// re-reading the backend list each time so backends added or removed at
+// runtime (see AddBackend, RemoveBackend) are picked up automatically.
+func (h *HealthChecker) run() {
+	ticker := time.NewTicker(h.opts.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-h.stop:
+			return
+		case <-ticker.C:
+			for _, b := range h.lb.snapshotBackends() {
+				h.probe(b)
+			}
+		}
+	}
+}
+
+func (h *HealthChecker) probe(b *backend) {
+	u := *b.url
+	u.Path = h.opts.Path
+	resp, err := h.client.Get(u.String())
+	if err != nil {
+		h.reportFailure(b)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != h.opts.ExpectedStatus {
+		h.reportFailure(b)
+		return
+	}
+	h.reportSuccess(b)
+}
+
+// reportFailure records a probe or passive failure against b, evicting it
+// from selection once UnhealthyThreshold consecutive failures are seen.
+func (h *HealthChecker) reportFailure(b *backend) {
+	if atomic.LoadInt32(&b.streak) > 0 {
+		atomic.StoreInt32(&b.streak, 0)
+	}
+	streak := atomic.AddInt32(&b.streak, -1)
+	if -streak >= int32(h.opts.UnhealthyThreshold) {
+		atomic.StoreInt32(&b.healthy, 0)
+	}
+}
+
+// reportSuccess records a probe or passive success against b, re-admitting
+// it to selection once HealthyThreshold consecutive successes are seen.
+func (h *HealthChecker) reportSuccess(b *backend) {
+	if atomic.LoadInt32(&b.streak) < 0 {
+		atomic.StoreInt32(&b.streak, 0)
+	}
+	streak := atomic.AddInt32(&b.streak, 1)
+	if streak >= int32(h.opts.HealthyThreshold) {
+		atomic.StoreInt32(&b.healthy, 1)
+	}
+}
+
+func (h *HealthChecker) close() {
+	close(h.stop)
+}
+
+// statusWriter wraps an http.ResponseWriter to capture the status code and
+// response size a handler writes, for passive health tracking and metrics.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the wrapped writer, so the
+// reverse proxy can still flush streamed responses through statusWriter.
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// LoadBalancerOptions configures optional LoadBalancer subsystems.
+type LoadBalancerOptions struct {
+	// Policy selects backends. Defaults to LeastConnPolicy{}.
+	Policy SelectionPolicy
+	// HealthCheck, if set, enables active and passive health checking.
+	HealthCheck *HealthCheckOptions
+	// FlushInterval, if non-zero, is set on the ReverseProxy of every
+	// backend given at construction so streamed responses (SSE, chunked)
+	// are flushed to the client as they arrive instead of being buffered.
+	// Backends added later with AddBackend keep the ReverseProxy default.
+	// See httputil.ReverseProxy.
+	FlushInterval time.Duration
+	// MetricsSink, if set, is notified each time a backend finishes
+	// serving a request through its ReverseProxy (with Retry, once per
+	// attempt). Upgraded connections are not reported. Use
+	// NewPrometheusMetrics for a built-in sink that also exposes a
+	// Prometheus text-format Handler.
+	MetricsSink MetricsSink
+	// Retry, if set, enables retrying (and optionally hedging) requests
+	// against a different backend on failure.
+	Retry *RetryPolicy
+}
+
+// NewLoadBalancerWithOptions creates a LoadBalancer configured by opts.
+func NewLoadBalancerWithOptions(opts LoadBalancerOptions, hosts ...string) (*LoadBalancer, error) {
+	policy := opts.Policy
+	if policy == nil {
+		policy = LeastConnPolicy{}
+	}
+	lb, err := NewLoadBalancerWithPolicy(policy, hosts...)
+	if err != nil {
+		return nil, err
+	}
+	if opts.FlushInterval != 0 {
+		for _, b := range lb.p.backends {
+			b.r.FlushInterval = opts.FlushInterval
+		}
+	}
+	if opts.MetricsSink != nil {
+		lb.metrics = opts.MetricsSink
+		for _, b := range lb.p.backends {
+			b.metrics = opts.MetricsSink
+		}
+	}
+	if opts.HealthCheck != nil {
+		lb.enableHealthCheck(*opts.HealthCheck)
+	}
+	lb.retry = opts.Retry
+	return lb, nil
+}
+
+func (lb *LoadBalancer) enableHealthCheck(opts HealthCheckOptions) {
+	checker := newHealthChecker(lb, opts)
+	lb.checker = checker
+	for _, b := range lb.p.backends {
+		lb.wireChecker(b)
+	}
+	go checker.run()
+}
+
+// wireChecker attaches lb's HealthChecker to b. Its reverse proxy answers
+// transport errors with a 502, which Backend.handle then reports to the
+// checker as a single passive failure.
+func (lb *LoadBalancer) wireChecker(b *backend) {
+	checker := lb.checker
+	b.checker = checker
+	b.r.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		w.WriteHeader(http.StatusBadGateway)
+	}
+}
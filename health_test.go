@@ -0,0 +1,44 @@
+// Copyright 2013 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lb
+
+import "testing"
+
+func TestHealthCheckerReportFailureEvicts(t *testing.T) {
+	h := newHealthChecker(nil, HealthCheckOptions{UnhealthyThreshold: 2, HealthyThreshold: 2})
+	b := &backend{healthy: 1}
+	h.reportFailure(b)
+	if b.healthy != 1 {
+		t.Errorf("backend should still be healthy after 1 failure. Got healthy=%d.", b.healthy)
+	}
+	h.reportFailure(b)
+	if b.healthy != 0 {
+		t.Errorf("backend should be unhealthy after 2 consecutive failures. Got healthy=%d.", b.healthy)
+	}
+}
+
+func TestHealthCheckerReportSuccessReadmits(t *testing.T) {
+	h := newHealthChecker(nil, HealthCheckOptions{UnhealthyThreshold: 2, HealthyThreshold: 2})
+	b := &backend{healthy: 0}
+	h.reportSuccess(b)
+	if b.healthy != 0 {
+		t.Errorf("backend should still be unhealthy after 1 success. Got healthy=%d.", b.healthy)
+	}
+	h.reportSuccess(b)
+	if b.healthy != 1 {
+		t.Errorf("backend should be healthy after 2 consecutive successes. Got healthy=%d.", b.healthy)
+	}
+}
+
+func TestHealthCheckerStreakResetsOnOutcomeChange(t *testing.T) {
+	h := newHealthChecker(nil, HealthCheckOptions{UnhealthyThreshold: 2, HealthyThreshold: 2})
+	b := &backend{healthy: 1}
+	h.reportFailure(b)
+	h.reportSuccess(b)
+	h.reportFailure(b)
+	if b.healthy != 1 {
+		t.Errorf("a single failure after a success should not evict. Got healthy=%d.", b.healthy)
+	}
+}
@@ -6,68 +6,359 @@ package lb
 
 import (
 	"container/heap"
+	"hash/fnv"
+	"io"
+	"math/rand"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
-type Backend struct {
-	i    int
-	load int
-	r    *httputil.ReverseProxy
+// counter is a concurrency-safe request counter, used to track how many
+// in-flight requests a backend is currently handling.
+type counter struct {
+	n int64
 }
 
-func (b *Backend) handle(w http.ResponseWriter, r *http.Request, done chan<- *Backend) {
-	b.r.ServeHTTP(w, r)
+func (c *counter) increment() {
+	atomic.AddInt64(&c.n, 1)
+}
+
+func (c *counter) decrement() {
+	atomic.AddInt64(&c.n, -1)
+}
+
+func (c *counter) val() int64 {
+	return atomic.LoadInt64(&c.n)
+}
+
+type backend struct {
+	i       int32
+	load    counter
+	weight  int
+	url     *url.URL
+	r       *httputil.ReverseProxy
+	checker *HealthChecker
+	metrics MetricsSink
+	healthy int32 // 1 if the backend is passing health checks, 0 otherwise
+	streak  int32 // consecutive successes (positive) or failures (negative)
+	drained int32 // 1 once DrainBackend has excluded this backend from selection
+}
+
+func (b *backend) handle(w http.ResponseWriter, r *http.Request, done chan<- *backend) {
+	if b.checker == nil && b.metrics == nil {
+		b.r.ServeHTTP(w, r)
+		done <- b
+		return
+	}
+	start := time.Now()
+	sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+	b.r.ServeHTTP(sw, r)
+	if b.checker != nil {
+		if sw.status >= http.StatusInternalServerError {
+			b.checker.reportFailure(b)
+		} else {
+			b.checker.reportSuccess(b)
+		}
+	}
+	if b.metrics != nil {
+		b.metrics.Observe(RequestMetric{
+			Backend:  b.url.String(),
+			Status:   sw.status,
+			Bytes:    sw.bytes,
+			Duration: time.Since(start),
+		})
+	}
 	done <- b
 }
 
-type Pool []*Backend
+// pool is a min-heap of backends ordered by load, kept up to date in
+// O(log n) as load changes. Policies receive the eligible backends in this
+// heap order; LeastConnPolicy still scans them for the lowest load.
+type pool struct {
+	backends []*backend
+}
 
-func (p *Pool) Len() int {
-	return len(*p)
+func (p *pool) Len() int {
+	return len(p.backends)
 }
 
-func (p *Pool) Less(i, j int) bool {
-	return (*p)[i].load < (*p)[j].load
+func (p *pool) Less(i, j int) bool {
+	return p.backends[i].load.val() < p.backends[j].load.val()
 }
 
-func (p *Pool) Swap(i, j int) {
-	(*p)[i], (*p)[j] = (*p)[j], (*p)[i]
+func (p *pool) Swap(i, j int) {
+	p.backends[i], p.backends[j] = p.backends[j], p.backends[i]
+	p.backends[i].i = int32(i)
+	p.backends[j].i = int32(j)
 }
 
-func (p *Pool) Push(x interface{}) {
-	b := x.(*Backend)
-	b.i = p.Len()
-	*p = (*p)[:b.i+1]
-	(*p)[b.i] = b
+func (p *pool) Push(x interface{}) {
+	b := x.(*backend)
+	b.i = int32(len(p.backends))
+	p.backends = append(p.backends, b)
 }
 
-func (p *Pool) Pop() interface{} {
-	b := (*p)[p.Len()-1]
+func (p *pool) Pop() interface{} {
+	old := p.backends
+	n := len(old)
+	b := old[n-1]
 	b.i = -1
-	(*p) = (*p)[:p.Len()-1]
+	p.backends = old[:n-1]
 	return b
 }
 
+// SelectionPolicy picks which backend should serve a given request, and
+// is notified when that request finishes so it can update any bookkeeping
+// it needs for future selections (e.g. round-robin position, weighted
+// counters). Implementations must be safe for concurrent use.
+type SelectionPolicy interface {
+	Select(r *http.Request, backends []*backend) *backend
+	Released(b *backend)
+}
+
+// LeastConnPolicy selects the backend with the fewest in-flight requests.
+// This is the default policy.
+type LeastConnPolicy struct{}
+
+func (LeastConnPolicy) Select(r *http.Request, backends []*backend) *backend {
+	if len(backends) == 0 {
+		return nil
+	}
+	least := backends[0]
+	for _, b := range backends[1:] {
+		if b.load.val() < least.load.val() {
+			least = b
+		}
+	}
+	return least
+}
+
+func (LeastConnPolicy) Released(b *backend) {}
+
+// RoundRobinPolicy cycles through backends in order, ignoring load.
+type RoundRobinPolicy struct {
+	mu   sync.Mutex
+	next int
+}
+
+func (p *RoundRobinPolicy) Select(r *http.Request, backends []*backend) *backend {
+	if len(backends) == 0 {
+		return nil
+	}
+	p.mu.Lock()
+	b := backends[p.next%len(backends)]
+	p.next++
+	p.mu.Unlock()
+	return b
+}
+
+func (p *RoundRobinPolicy) Released(b *backend) {}
+
+// RandomPolicy selects a backend uniformly at random, ignoring load.
+type RandomPolicy struct{}
+
+func (RandomPolicy) Select(r *http.Request, backends []*backend) *backend {
+	if len(backends) == 0 {
+		return nil
+	}
+	return backends[rand.Intn(len(backends))]
+}
+
+func (RandomPolicy) Released(b *backend) {}
+
+// FirstAvailablePolicy always selects the first backend in the pool,
+// regardless of load. It is mainly useful for primary/backup setups
+// where the remaining backends only matter if the first is unhealthy.
+type FirstAvailablePolicy struct{}
+
+func (FirstAvailablePolicy) Select(r *http.Request, backends []*backend) *backend {
+	if len(backends) == 0 {
+		return nil
+	}
+	return backends[0]
+}
+
+func (FirstAvailablePolicy) Released(b *backend) {}
+
+// WeightedRoundRobinPolicy distributes requests across backends in
+// proportion to their Weight, using the smooth weighted round-robin
+// algorithm (as used by nginx). A backend with Weight <= 0 is treated
+// as having a weight of 1.
+type WeightedRoundRobinPolicy struct {
+	mu      sync.Mutex
+	current map[*backend]int
+}
+
+// NewWeightedRoundRobinPolicy returns a WeightedRoundRobinPolicy ready for use.
+func NewWeightedRoundRobinPolicy() *WeightedRoundRobinPolicy {
+	return &WeightedRoundRobinPolicy{current: make(map[*backend]int)}
+}
+
+func (p *WeightedRoundRobinPolicy) Select(r *http.Request, backends []*backend) *backend {
+	if len(backends) == 0 {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var best *backend
+	total := 0
+	for _, b := range backends {
+		w := b.weight
+		if w <= 0 {
+			w = 1
+		}
+		p.current[b] += w
+		total += w
+		if best == nil || p.current[b] > p.current[best] {
+			best = b
+		}
+	}
+	p.current[best] -= total
+	return best
+}
+
+func (p *WeightedRoundRobinPolicy) Released(b *backend) {}
+
+// IPHashPolicy hashes a request's client address into a backend, giving
+// session affinity: requests from the same client consistently land on
+// the same backend as long as the pool is unchanged. By default it
+// hashes the X-Forwarded-For header, falling back to RemoteAddr; set
+// Header to consult a different header instead.
+type IPHashPolicy struct {
+	Header string
+}
+
+func (p *IPHashPolicy) Select(r *http.Request, backends []*backend) *backend {
+	if len(backends) == 0 {
+		return nil
+	}
+	header := p.Header
+	if header == "" {
+		header = "X-Forwarded-For"
+	}
+	key := r.Header.Get(header)
+	if key == "" {
+		key = r.RemoteAddr
+	}
+	h := fnv.New32a()
+	io.WriteString(h, key)
+	return backends[h.Sum32()%uint32(len(backends))]
+}
+
+func (p *IPHashPolicy) Released(b *backend) {}
+
 type LoadBalancer struct {
-	p    Pool
-	done chan *Backend
+	mu      sync.Mutex // guards p; the heap must not be mutated concurrently
+	p       pool
+	done    chan *backend
+	stopped chan struct{} // closed once run exits, after done is closed and drained
+	policy  SelectionPolicy
+	checker *HealthChecker
+	metrics MetricsSink
+	retry   *RetryPolicy
 }
 
+// NewLoadBalancer creates a LoadBalancer that selects backends using
+// LeastConnPolicy, the historical default behavior.
 func NewLoadBalancer(hosts ...string) (*LoadBalancer, error) {
-	backends := make([]*Backend, 0, len(hosts))
-	p := Pool(backends)
-	lb := LoadBalancer{
-		p:    p,
-		done: make(chan *Backend, len(hosts)),
+	return NewLoadBalancerWithPolicy(LeastConnPolicy{}, hosts...)
+}
+
+// NewLoadBalancerWithPolicy creates a LoadBalancer that selects backends
+// using the given SelectionPolicy.
+func NewLoadBalancerWithPolicy(policy SelectionPolicy, hosts ...string) (*LoadBalancer, error) {
+	lb := &LoadBalancer{
+		p:       pool{backends: make([]*backend, 0, len(hosts))},
+		done:    make(chan *backend, len(hosts)),
+		stopped: make(chan struct{}),
+		policy:  policy,
 	}
 	for _, h := range hosts {
 		u, err := url.Parse(h)
 		if err != nil {
 			return nil, err
 		}
-		heap.Push(&lb.p, &Backend{r: httputil.NewSingleHostReverseProxy(u)})
+		heap.Push(&lb.p, &backend{weight: 1, healthy: 1, url: u, r: httputil.NewSingleHostReverseProxy(u)})
+	}
+	go lb.run()
+	return lb, nil
+}
+
+// run delivers every backend finishing a request to requestFinished. It
+// closes stopped once done is closed and fully drained, giving callers
+// outside the lb.mu/done/policy synchronization (such as white-box tests
+// that poke lb.p directly) a proper happens-before edge to wait on instead
+// of guessing with a sleep.
+func (lb *LoadBalancer) run() {
+	defer close(lb.stopped)
+	for b := range lb.done {
+		lb.requestFinished(b)
+	}
+}
+
+func (lb *LoadBalancer) requestFinished(b *backend) {
+	lb.mu.Lock()
+	b.load.decrement()
+	if b.i >= 0 {
+		heap.Fix(&lb.p, int(b.i))
+	}
+	lb.mu.Unlock()
+	lb.policy.Released(b)
+}
+
+func (lb *LoadBalancer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b := lb.selectBackend(r)
+	if b == nil {
+		http.Error(w, "no backends available", http.StatusServiceUnavailable)
+		return
+	}
+	if isUpgrade(r) {
+		lb.serveUpgrade(w, r, b)
+		return
+	}
+	if lb.retry != nil {
+		lb.serveWithRetry(w, r, b)
+		return
+	}
+	b.handle(w, r, lb.done)
+}
+
+// selectBackend asks policy to pick a backend out of the currently
+// eligible ones and accounts for the request against it, or returns nil
+// if no backend is eligible.
+func (lb *LoadBalancer) selectBackend(r *http.Request) *backend {
+	b := lb.policy.Select(r, lb.eligibleBackends())
+	if b == nil {
+		return nil
+	}
+	lb.mu.Lock()
+	b.load.increment()
+	if b.i >= 0 {
+		heap.Fix(&lb.p, int(b.i))
+	}
+	lb.mu.Unlock()
+	return b
+}
+
+// eligibleBackends returns the backends currently eligible for selection:
+// every registered backend, minus any that are unhealthy (when a health
+// checker is configured) or draining.
+func (lb *LoadBalancer) eligibleBackends() []*backend {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	eligible := make([]*backend, 0, len(lb.p.backends))
+	for _, b := range lb.p.backends {
+		if lb.checker != nil && atomic.LoadInt32(&b.healthy) == 0 {
+			continue
+		}
+		if atomic.LoadInt32(&b.drained) == 1 {
+			continue
+		}
+		eligible = append(eligible, b)
 	}
-	return &lb, nil
+	return eligible
 }
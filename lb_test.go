@@ -6,13 +6,13 @@ package lb
 
 import (
 	"container/heap"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"net/http/httputil"
 	"net/url"
 	"reflect"
 	"testing"
-	"time"
 )
 
 type FakeHandler struct {
@@ -201,7 +201,7 @@ func TestNewLoadBalancerInvalidURL(t *testing.T) {
 		t.Error("Expected non-nil error, got <nil>.")
 	}
 	if lb != nil {
-		t.Errorf("Want <nil>. Got %#v.", *lb)
+		t.Errorf("Want <nil>. Got %#v.", lb)
 	}
 }
 
@@ -219,7 +219,6 @@ func TestLoadBalancerServeHTTP(t *testing.T) {
 		t.Fatal(err)
 	}
 	lb.ServeHTTP(recorder, req)
-	<-lb.done
 	var h *FakeHandler
 	if len(h1.requests) > 0 {
 		h = h1
@@ -239,6 +238,30 @@ func TestLoadBalancerServeHTTP(t *testing.T) {
 	}
 }
 
+func TestLoadBalancerServeHTTPRealServer(t *testing.T) {
+	msg := "Hello from a real server."
+	backendServer := httptest.NewServer(&FakeHandler{msg: []byte(msg)})
+	defer backendServer.Close()
+	lb, err := NewLoadBalancer(backendServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frontend := httptest.NewServer(lb)
+	defer frontend.Close()
+	resp, err := http.Get(frontend.URL + "/something")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != msg {
+		t.Errorf("Wrong response. Want %q. Got %q.", msg, string(body))
+	}
+}
+
 func TestLoadBalancerRequestFinished(t *testing.T) {
 	lb, err := NewLoadBalancer("http://localhost:8080")
 	if err != nil {
@@ -265,7 +288,7 @@ func TestLoadBalancerHandleFinishes(t *testing.T) {
 	b := lb.p.backends[0]
 	lb.done <- b
 	close(lb.done)
-	time.Sleep(1e6)
+	<-lb.stopped
 	if b.load.val() != 0 {
 		t.Errorf("Wrong load after requestFinished. Want %d. Got %d", 0, b.load.val())
 	}
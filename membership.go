@@ -0,0 +1,116 @@
+// Copyright 2013 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lb
+
+import (
+	"container/heap"
+	"fmt"
+	"net/http/httputil"
+	"net/url"
+	"sync/atomic"
+	"time"
+)
+
+// BackendInfo is a point-in-time snapshot of a backend's state, returned
+// by LoadBalancer.Backends for observability.
+type BackendInfo struct {
+	URL     string
+	Load    int64
+	Weight  int
+	Healthy bool
+	Drained bool
+}
+
+// AddBackend registers a new backend at rawurl, making it immediately
+// eligible for selection.
+func (lb *LoadBalancer) AddBackend(rawurl string) error {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return err
+	}
+	b := &backend{weight: 1, healthy: 1, url: u, r: httputil.NewSingleHostReverseProxy(u)}
+	lb.mu.Lock()
+	if lb.checker != nil {
+		lb.wireChecker(b)
+	}
+	if lb.metrics != nil {
+		b.metrics = lb.metrics
+	}
+	heap.Push(&lb.p, b)
+	lb.mu.Unlock()
+	return nil
+}
+
+// RemoveBackend immediately removes the backend at rawurl from the pool,
+// regardless of in-flight requests. Callers that need in-flight requests
+// to complete first should use DrainBackend instead.
+func (lb *LoadBalancer) RemoveBackend(rawurl string) error {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	for i, b := range lb.p.backends {
+		if b.url.String() == rawurl {
+			heap.Remove(&lb.p, i)
+			return nil
+		}
+	}
+	return fmt.Errorf("lb: no such backend: %s", rawurl)
+}
+
+// DrainBackend marks the backend at rawurl as draining, so ServeHTTP stops
+// routing new requests to it, then waits for its in-flight load to reach
+// zero (or timeout to elapse) before removing it from the pool.
+func (lb *LoadBalancer) DrainBackend(rawurl string, timeout time.Duration) error {
+	b, err := lb.findBackend(rawurl)
+	if err != nil {
+		return err
+	}
+	atomic.StoreInt32(&b.drained, 1)
+
+	deadline := time.Now().Add(timeout)
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for b.load.val() > 0 && time.Now().Before(deadline) {
+		<-ticker.C
+	}
+	return lb.RemoveBackend(rawurl)
+}
+
+func (lb *LoadBalancer) findBackend(rawurl string) (*backend, error) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	for _, b := range lb.p.backends {
+		if b.url.String() == rawurl {
+			return b, nil
+		}
+	}
+	return nil, fmt.Errorf("lb: no such backend: %s", rawurl)
+}
+
+// snapshotBackends returns a copy of the current backend list, safe to
+// range over without holding lb.mu.
+func (lb *LoadBalancer) snapshotBackends() []*backend {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	out := make([]*backend, len(lb.p.backends))
+	copy(out, lb.p.backends)
+	return out
+}
+
+// Backends returns a snapshot of every registered backend, for
+// observability and tooling.
+func (lb *LoadBalancer) Backends() []BackendInfo {
+	backends := lb.snapshotBackends()
+	infos := make([]BackendInfo, len(backends))
+	for i, b := range backends {
+		infos[i] = BackendInfo{
+			URL:     b.url.String(),
+			Load:    b.load.val(),
+			Weight:  b.weight,
+			Healthy: atomic.LoadInt32(&b.healthy) == 1,
+			Drained: atomic.LoadInt32(&b.drained) == 1,
+		}
+	}
+	return infos
+}
@@ -0,0 +1,69 @@
+// Copyright 2013 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lb
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLoadBalancerAddBackend(t *testing.T) {
+	lb, err := NewLoadBalancer("http://localhost:8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := lb.AddBackend("http://localhost:8081"); err != nil {
+		t.Fatal(err)
+	}
+	backends := lb.Backends()
+	if len(backends) != 2 {
+		t.Errorf("Want 2 backends after AddBackend. Got %d.", len(backends))
+	}
+}
+
+func TestLoadBalancerRemoveBackend(t *testing.T) {
+	lb, err := NewLoadBalancer("http://localhost:8080", "http://localhost:8081")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := lb.RemoveBackend("http://localhost:8081"); err != nil {
+		t.Fatal(err)
+	}
+	backends := lb.Backends()
+	if len(backends) != 1 {
+		t.Errorf("Want 1 backend after RemoveBackend. Got %d.", len(backends))
+	}
+	if err := lb.RemoveBackend("http://localhost:9999"); err == nil {
+		t.Error("Expected error removing unknown backend, got <nil>.")
+	}
+}
+
+func TestLoadBalancerDrainBackend(t *testing.T) {
+	server := httptest.NewServer(&FakeHandler{msg: []byte("hi")})
+	defer server.Close()
+	lb, err := NewLoadBalancer(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := lb.DrainBackend(server.URL, 100*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if len(lb.Backends()) != 0 {
+		t.Errorf("Want 0 backends after DrainBackend with no in-flight requests. Got %d.", len(lb.Backends()))
+	}
+}
+
+func TestLoadBalancerDrainBackendExcludesFromSelection(t *testing.T) {
+	lb, err := NewLoadBalancer("http://localhost:8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go lb.DrainBackend("http://localhost:8080", time.Second)
+	time.Sleep(10 * time.Millisecond)
+	if got := len(lb.eligibleBackends()); got != 0 {
+		t.Errorf("Want 0 eligible backends while draining. Got %d.", got)
+	}
+}
@@ -0,0 +1,222 @@
+// Copyright 2013 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lb
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// RequestMetric describes a single completed request, reported to a
+// MetricsSink by Backend.handle.
+type RequestMetric struct {
+	Backend  string
+	Status   int
+	Bytes    int64
+	Duration time.Duration
+}
+
+// MetricsSink receives per-request observations, letting users plug in an
+// external metrics system (statsd, OpenTelemetry, ...). Implementations
+// must be safe for concurrent use.
+type MetricsSink interface {
+	Observe(m RequestMetric)
+}
+
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type backendStats struct {
+	mu         sync.Mutex
+	requests   int64
+	bytes      int64
+	status2xx  int64
+	status4xx  int64
+	status5xx  int64
+	other      int64
+	latencySum float64
+	// bucketCounts[i] holds the number of observations whose latency, in
+	// seconds, falls in (latencyBuckets[i-1], latencyBuckets[i]]; the last
+	// slot is the +Inf bucket.
+	bucketCounts []int64
+}
+
+func newBackendStats() *backendStats {
+	return &backendStats{bucketCounts: make([]int64, len(latencyBuckets)+1)}
+}
+
+// backendStatsSnapshot is a point-in-time, lock-free copy of backendStats,
+// taken so serveHTTP can render a response without holding s.mu (or
+// PrometheusMetrics.mu) for the duration of the write.
+type backendStatsSnapshot struct {
+	requests     int64
+	bytes        int64
+	status2xx    int64
+	status4xx    int64
+	status5xx    int64
+	other        int64
+	latencySum   float64
+	bucketCounts []int64
+}
+
+func (s *backendStats) snapshot() backendStatsSnapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	bucketCounts := make([]int64, len(s.bucketCounts))
+	copy(bucketCounts, s.bucketCounts)
+	return backendStatsSnapshot{
+		requests:     s.requests,
+		bytes:        s.bytes,
+		status2xx:    s.status2xx,
+		status4xx:    s.status4xx,
+		status5xx:    s.status5xx,
+		other:        s.other,
+		latencySum:   s.latencySum,
+		bucketCounts: bucketCounts,
+	}
+}
+
+func (s *backendStats) observe(m RequestMetric) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests++
+	s.bytes += m.Bytes
+	switch {
+	case m.Status >= 200 && m.Status < 300:
+		s.status2xx++
+	case m.Status >= 400 && m.Status < 500:
+		s.status4xx++
+	case m.Status >= 500:
+		s.status5xx++
+	default:
+		s.other++
+	}
+	secs := m.Duration.Seconds()
+	s.latencySum += secs
+	bucket := len(latencyBuckets)
+	for i, bound := range latencyBuckets {
+		if secs <= bound {
+			bucket = i
+			break
+		}
+	}
+	s.bucketCounts[bucket]++
+}
+
+// PrometheusMetrics is a built-in MetricsSink that keeps per-backend
+// counters and a request-latency histogram in memory, and renders them in
+// Prometheus text exposition format via Handler.
+type PrometheusMetrics struct {
+	lb *LoadBalancer
+
+	mu    sync.Mutex
+	stats map[string]*backendStats
+}
+
+// NewPrometheusMetrics returns a PrometheusMetrics sink. lb is optional and,
+// when given, is used to report pool-wide gauges (healthy backend count,
+// total in-flight load) alongside the per-backend counters.
+func NewPrometheusMetrics(lb *LoadBalancer) *PrometheusMetrics {
+	return &PrometheusMetrics{lb: lb, stats: make(map[string]*backendStats)}
+}
+
+func (m *PrometheusMetrics) Observe(rm RequestMetric) {
+	m.mu.Lock()
+	s, ok := m.stats[rm.Backend]
+	if !ok {
+		s = newBackendStats()
+		m.stats[rm.Backend] = s
+	}
+	m.mu.Unlock()
+	s.observe(rm)
+}
+
+// Handler renders all recorded metrics in Prometheus text exposition
+// format.
+func (m *PrometheusMetrics) Handler() http.Handler {
+	return http.HandlerFunc(m.serveHTTP)
+}
+
+func (m *PrometheusMetrics) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	// Snapshot everything we need up front and release both m.mu and each
+	// backendStats.mu before writing a single byte to w: a slow or stalled
+	// scraper must never hold these locks for the duration of the write,
+	// since that would stall every concurrent Observe() call repo-wide.
+	m.mu.Lock()
+	backends := make([]string, 0, len(m.stats))
+	for backend := range m.stats {
+		backends = append(backends, backend)
+	}
+	m.mu.Unlock()
+	sort.Strings(backends)
+
+	snapshots := make(map[string]backendStatsSnapshot, len(backends))
+	for _, backend := range backends {
+		m.mu.Lock()
+		s := m.stats[backend]
+		m.mu.Unlock()
+		snapshots[backend] = s.snapshot()
+	}
+
+	var healthyBackends int
+	var totalLoad int64
+	if m.lb != nil {
+		healthyBackends = len(m.lb.eligibleBackends())
+		for _, b := range m.lb.snapshotBackends() {
+			totalLoad += b.load.val()
+		}
+	}
+
+	fmt.Fprintln(w, "# HELP lb_backend_requests_total Total requests routed to a backend.")
+	fmt.Fprintln(w, "# TYPE lb_backend_requests_total counter")
+	for _, backend := range backends {
+		fmt.Fprintf(w, "lb_backend_requests_total{backend=%q} %d\n", backend, snapshots[backend].requests)
+	}
+
+	fmt.Fprintln(w, "# HELP lb_backend_response_bytes_total Total response bytes sent by a backend.")
+	fmt.Fprintln(w, "# TYPE lb_backend_response_bytes_total counter")
+	for _, backend := range backends {
+		fmt.Fprintf(w, "lb_backend_response_bytes_total{backend=%q} %d\n", backend, snapshots[backend].bytes)
+	}
+
+	fmt.Fprintln(w, "# HELP lb_backend_responses_total Responses from a backend, by status class.")
+	fmt.Fprintln(w, "# TYPE lb_backend_responses_total counter")
+	for _, backend := range backends {
+		s := snapshots[backend]
+		fmt.Fprintf(w, "lb_backend_responses_total{backend=%q,class=\"2xx\"} %d\n", backend, s.status2xx)
+		fmt.Fprintf(w, "lb_backend_responses_total{backend=%q,class=\"4xx\"} %d\n", backend, s.status4xx)
+		fmt.Fprintf(w, "lb_backend_responses_total{backend=%q,class=\"5xx\"} %d\n", backend, s.status5xx)
+		fmt.Fprintf(w, "lb_backend_responses_total{backend=%q,class=\"other\"} %d\n", backend, s.other)
+	}
+
+	fmt.Fprintln(w, "# HELP lb_backend_request_duration_seconds Request latency, by backend.")
+	fmt.Fprintln(w, "# TYPE lb_backend_request_duration_seconds histogram")
+	for _, backend := range backends {
+		s := snapshots[backend]
+		var cumulative int64
+		for i, bound := range latencyBuckets {
+			cumulative += s.bucketCounts[i]
+			fmt.Fprintf(w, "lb_backend_request_duration_seconds_bucket{backend=%q,le=%q} %d\n", backend, fmt.Sprintf("%g", bound), cumulative)
+		}
+		cumulative += s.bucketCounts[len(latencyBuckets)]
+		fmt.Fprintf(w, "lb_backend_request_duration_seconds_bucket{backend=%q,le=\"+Inf\"} %d\n", backend, cumulative)
+		fmt.Fprintf(w, "lb_backend_request_duration_seconds_sum{backend=%q} %g\n", backend, s.latencySum)
+		fmt.Fprintf(w, "lb_backend_request_duration_seconds_count{backend=%q} %d\n", backend, cumulative)
+	}
+
+	if m.lb != nil {
+		fmt.Fprintln(w, "# HELP lb_healthy_backends Backends currently eligible for selection.")
+		fmt.Fprintln(w, "# TYPE lb_healthy_backends gauge")
+		fmt.Fprintf(w, "lb_healthy_backends %d\n", healthyBackends)
+
+		fmt.Fprintln(w, "# HELP lb_total_load Sum of in-flight requests across all backends.")
+		fmt.Fprintln(w, "# TYPE lb_total_load gauge")
+		fmt.Fprintf(w, "lb_total_load %d\n", totalLoad)
+	}
+}
@@ -0,0 +1,48 @@
+// Copyright 2013 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lb
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPrometheusMetricsObserveAndRender(t *testing.T) {
+	m := NewPrometheusMetrics(nil)
+	m.Observe(RequestMetric{Backend: "http://backend1", Status: 200, Bytes: 42, Duration: 10 * time.Millisecond})
+	m.Observe(RequestMetric{Backend: "http://backend1", Status: 500, Bytes: 0, Duration: time.Second})
+
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	rec := httptest.NewRecorder()
+	m.Handler().ServeHTTP(rec, req)
+
+	body := rec.Body.String()
+	if !strings.Contains(body, `lb_backend_requests_total{backend="http://backend1"} 2`) {
+		t.Errorf("Expected request count of 2 in output. Got:\n%s", body)
+	}
+	if !strings.Contains(body, `lb_backend_responses_total{backend="http://backend1",class="5xx"} 1`) {
+		t.Errorf("Expected one 5xx response in output. Got:\n%s", body)
+	}
+	if !strings.Contains(body, `lb_backend_response_bytes_total{backend="http://backend1"} 42`) {
+		t.Errorf("Expected 42 response bytes in output. Got:\n%s", body)
+	}
+}
+
+func TestPrometheusMetricsWithLoadBalancer(t *testing.T) {
+	lb, err := NewLoadBalancer("http://localhost:8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewPrometheusMetrics(lb)
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	rec := httptest.NewRecorder()
+	m.Handler().ServeHTTP(rec, req)
+	body := rec.Body.String()
+	if !strings.Contains(body, "lb_healthy_backends 1") {
+		t.Errorf("Expected 1 healthy backend in output. Got:\n%s", body)
+	}
+}
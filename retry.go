@@ -0,0 +1,369 @@
+// Copyright 2013 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lb
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type retryContextKey struct{}
+
+// WithRetry returns a context that opts a request into LoadBalancer's
+// RetryPolicy even though its method isn't inherently idempotent (e.g. a
+// POST). The caller is asserting that retrying the request is safe.
+func WithRetry(ctx context.Context) context.Context {
+	return context.WithValue(ctx, retryContextKey{}, true)
+}
+
+func retryAllowed(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	opted, _ := r.Context().Value(retryContextKey{}).(bool)
+	return opted
+}
+
+// HedgePolicy configures hedged requests: if the primary attempt hasn't
+// finished after Delay, a duplicate is dispatched to a second backend, and
+// whichever responds first wins; the other is cancelled.
+type HedgePolicy struct {
+	Delay time.Duration
+}
+
+// RetryPolicy re-dispatches a request when the first backend fails, up to
+// MaxRetries times within Deadline. Each retry re-selects a backend through
+// the LoadBalancer's SelectionPolicy, which can pick the backend that just
+// failed; failed backends are not excluded from re-selection. A response
+// counts as failed if the backend couldn't be reached at all, or its
+// status is in RetriableStatus (default: 502, 503, 504). Retries only
+// happen for requests retryAllowed considers safe: idempotent methods, or
+// any method when the request's context was built with WithRetry.
+type RetryPolicy struct {
+	MaxRetries      int
+	RetriableStatus []int
+	// Deadline bounds the total time spent across all attempts. Defaults
+	// to 5s.
+	Deadline time.Duration
+	// MaxBodyBytes bounds how much of the request body is buffered so it
+	// can be replayed on retry; requests with a larger body are attempted
+	// once, without retries. Defaults to 1MiB.
+	MaxBodyBytes int64
+	// MaxResponseBufferBytes bounds how much of a response is buffered
+	// while deciding whether to retry it. A response that looks like a
+	// stream (chunked transfer encoding or text/event-stream) or that
+	// grows past this bound is passed straight through to the client
+	// instead: streaming responses can't be replayed, so that attempt
+	// forfeits any retries it had left rather than buffering an unbounded
+	// amount of memory. Defaults to 1MiB.
+	MaxResponseBufferBytes int64
+	// Hedge, if set, enables hedged requests on the first attempt. A hedge
+	// race buffers its response privately so the two races can be compared
+	// without one clobbering the other, so Hedge is not compatible with
+	// streaming backends: a race whose response looks like a stream (or
+	// grows past MaxResponseBufferBytes) is turned into a synthetic 502
+	// rather than risk forwarding a truncated body. Pair a streaming
+	// backend with RetryPolicy alone, without Hedge.
+	Hedge *HedgePolicy
+}
+
+func (p *RetryPolicy) maxRetries() int {
+	if p.MaxRetries < 0 {
+		return 0
+	}
+	return p.MaxRetries
+}
+
+func (p *RetryPolicy) deadline() time.Duration {
+	if p.Deadline <= 0 {
+		return 5 * time.Second
+	}
+	return p.Deadline
+}
+
+func (p *RetryPolicy) maxBodyBytes() int64 {
+	if p.MaxBodyBytes <= 0 {
+		return 1 << 20
+	}
+	return p.MaxBodyBytes
+}
+
+func (p *RetryPolicy) maxResponseBufferBytes() int64 {
+	if p.MaxResponseBufferBytes <= 0 {
+		return 1 << 20
+	}
+	return p.MaxResponseBufferBytes
+}
+
+func (p *RetryPolicy) retriable(status int) bool {
+	codes := p.RetriableStatus
+	if len(codes) == 0 {
+		codes = []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout}
+	}
+	for _, c := range codes {
+		if c == status {
+			return true
+		}
+	}
+	return false
+}
+
+// serveWithRetry serves r using the already-selected backend b, retrying
+// against a freshly selected backend per lb.retry until a non-retriable response
+// is obtained, retries are exhausted, the deadline passes, the request
+// turns out not to be safe to retry, or the response turns out to be a
+// stream that was passed straight through to w.
+func (lb *LoadBalancer) serveWithRetry(w http.ResponseWriter, r *http.Request, b *backend) {
+	policy := lb.retry
+	body, canRetry := bufferBody(r, policy)
+	deadline := time.Now().Add(policy.deadline())
+
+	var buf *bufferedResponse
+	for attempt := 0; attempt <= policy.maxRetries(); attempt++ {
+		if attempt > 0 {
+			if !canRetry || time.Now().After(deadline) {
+				break
+			}
+			nb := lb.selectBackend(r)
+			if nb == nil {
+				break
+			}
+			b = nb
+			resetBody(r, body)
+		}
+		if policy.Hedge != nil && canRetry && attempt == 0 {
+			buf = lb.hedgedAttempt(r, b, policy.Hedge.Delay, body)
+		} else {
+			buf = lb.attempt(w, r, b)
+		}
+		if buf.flushed {
+			// Already written straight through to w; nothing left to
+			// retry or buffer.
+			return
+		}
+		if !policy.retriable(buf.code) {
+			break
+		}
+	}
+	writeRecorded(w, buf)
+}
+
+// attempt runs r against b synchronously into a bufferedResponse that
+// writes straight through to w once the response turns out to be a
+// stream, so the caller can decide whether to retry a buffered response
+// before it reaches the client without buffering a stream in full.
+func (lb *LoadBalancer) attempt(w http.ResponseWriter, r *http.Request, b *backend) *bufferedResponse {
+	buf := newBufferedResponse(w, lb.retry.maxResponseBufferBytes())
+	b.handle(buf, r, lb.done)
+	return buf
+}
+
+// hedgedAttempt runs r against primary, and if it hasn't finished after
+// delay, also dispatches it to a second backend; whichever responds first
+// wins and the other attempt's context is cancelled. If the policy picks
+// primary again as the second backend, no duplicate is sent and that
+// selection's load is released. Both races buffer
+// into their own private bufferedResponse with no target, since two
+// concurrent racers can't safely share one ResponseWriter; see
+// bufferedResponse.cap for what happens to a race that looks like a
+// stream.
+//
+// r.Clone does not deep-copy Body, so without body, the two races would
+// share (and concurrently read) the same underlying reader; each clone
+// gets its own fresh reader over body instead, the same bytes bufferBody
+// already buffered for the non-hedge retry path.
+func (lb *LoadBalancer) hedgedAttempt(r *http.Request, primary *backend, delay time.Duration, body []byte) *bufferedResponse {
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	clone := func() *http.Request {
+		req := r.Clone(ctx)
+		if r.Body != nil && r.Body != http.NoBody {
+			resetBody(req, body)
+		}
+		return req
+	}
+
+	type result struct {
+		buf *bufferedResponse
+	}
+	results := make(chan result, 2)
+	run := func(b *backend, req *http.Request) {
+		buf := newBufferedResponse(nil, lb.retry.maxResponseBufferBytes())
+		b.handle(buf, req, lb.done)
+		results <- result{buf}
+	}
+
+	go run(primary, clone())
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case res := <-results:
+		return res.buf
+	case <-timer.C:
+		if secondary := lb.selectBackend(r); secondary != nil {
+			if secondary != primary {
+				go run(secondary, clone())
+			} else {
+				lb.done <- secondary
+			}
+		}
+		res := <-results
+		return res.buf
+	}
+}
+
+// bufferBody reads and buffers r's body (up to policy's limit) so it can
+// be replayed on retry, and reports whether retrying r is both safe
+// (retryAllowed) and possible (body fit within the limit).
+func bufferBody(r *http.Request, policy *RetryPolicy) (body []byte, canRetry bool) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, retryAllowed(r)
+	}
+	limit := policy.maxBodyBytes()
+	orig := r.Body
+	data, err := io.ReadAll(io.LimitReader(orig, limit+1))
+	if err != nil || int64(len(data)) > limit {
+		// Hand the backend the bytes already read followed by the rest of
+		// the original body, so the single attempt sees the whole body.
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(data), orig), orig}
+		return nil, false
+	}
+	orig.Close()
+	r.Body = io.NopCloser(bytes.NewReader(data))
+	return data, retryAllowed(r)
+}
+
+func resetBody(r *http.Request, body []byte) {
+	r.Body = io.NopCloser(bytes.NewReader(body))
+}
+
+func writeRecorded(w http.ResponseWriter, buf *bufferedResponse) {
+	header := w.Header()
+	for k, vs := range buf.header {
+		for _, v := range vs {
+			header.Add(k, v)
+		}
+	}
+	w.WriteHeader(buf.code)
+	w.Write(buf.body.Bytes())
+}
+
+// streamingResponse reports whether h looks like the headers of a
+// streaming response (SSE or chunked transfer encoding) that must not be
+// buffered in full before reaching the client.
+func streamingResponse(h http.Header) bool {
+	if strings.EqualFold(h.Get("Content-Type"), "text/event-stream") {
+		return true
+	}
+	for _, v := range h.Values("Transfer-Encoding") {
+		if strings.EqualFold(strings.TrimSpace(v), "chunked") {
+			return true
+		}
+	}
+	return false
+}
+
+// bufferedResponse is an http.ResponseWriter that buffers a backend's
+// response so serveWithRetry can inspect its status before deciding
+// whether to retry. A response that looks like a stream (streamingResponse)
+// or that grows past limit can't be buffered in full without risking an
+// unbounded memory footprint or a stream that never finishes, so
+// bufferedResponse gives up on buffering at that point (cap): with a
+// target, whatever was buffered is flushed straight through and further
+// writes pass through directly, forfeiting any retries left; without a
+// target (a hedge race, where two attempts can't safely share one
+// ResponseWriter), the attempt is turned into a synthetic 502 instead of
+// risking a truncated body reaching the client.
+type bufferedResponse struct {
+	target      http.ResponseWriter
+	limit       int64
+	header      http.Header
+	code        int
+	wroteHeader bool
+	body        bytes.Buffer
+	capped      bool
+	flushed     bool
+}
+
+func newBufferedResponse(target http.ResponseWriter, limit int64) *bufferedResponse {
+	return &bufferedResponse{target: target, limit: limit, header: make(http.Header)}
+}
+
+func (b *bufferedResponse) Header() http.Header {
+	return b.header
+}
+
+func (b *bufferedResponse) WriteHeader(code int) {
+	if b.wroteHeader {
+		return
+	}
+	b.wroteHeader = true
+	b.code = code
+	if streamingResponse(b.header) {
+		b.cap()
+	}
+}
+
+func (b *bufferedResponse) Write(p []byte) (int, error) {
+	if !b.wroteHeader {
+		b.WriteHeader(http.StatusOK)
+	}
+	if b.flushed {
+		return b.writeThrough(p)
+	}
+	if b.capped {
+		return len(p), nil
+	}
+	if int64(b.body.Len())+int64(len(p)) > b.limit {
+		b.cap()
+		if b.flushed {
+			return b.writeThrough(p)
+		}
+		return len(p), nil
+	}
+	return b.body.Write(p)
+}
+
+// cap gives up on buffering the response in full.
+func (b *bufferedResponse) cap() {
+	if b.capped {
+		return
+	}
+	b.capped = true
+	if b.target == nil {
+		b.code = http.StatusBadGateway
+		b.body.Reset()
+		return
+	}
+	target := b.target.Header()
+	for k, vs := range b.header {
+		target[k] = vs
+	}
+	b.target.WriteHeader(b.code)
+	if b.body.Len() > 0 {
+		b.target.Write(b.body.Bytes())
+		b.body.Reset()
+	}
+	b.flushed = true
+}
+
+func (b *bufferedResponse) writeThrough(p []byte) (int, error) {
+	n, err := b.target.Write(p)
+	if f, ok := b.target.(http.Flusher); ok {
+		f.Flush()
+	}
+	return n, err
+}
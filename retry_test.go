@@ -0,0 +1,163 @@
+// Copyright 2013 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lb
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRetryAllowed(t *testing.T) {
+	get, _ := http.NewRequest("GET", "/", nil)
+	if !retryAllowed(get) {
+		t.Error("Expected GET to be retryable.")
+	}
+	post, _ := http.NewRequest("POST", "/", nil)
+	if retryAllowed(post) {
+		t.Error("Expected POST to not be retryable by default.")
+	}
+	post = post.WithContext(WithRetry(context.Background()))
+	if !retryAllowed(post) {
+		t.Error("Expected POST with WithRetry context to be retryable.")
+	}
+}
+
+func TestLoadBalancerRetriesOnRetriableStatus(t *testing.T) {
+	var failed bool
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !failed {
+			failed = true
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer failing.Close()
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer healthy.Close()
+
+	lb, err := NewLoadBalancerWithOptions(LoadBalancerOptions{
+		Policy: &RoundRobinPolicy{},
+		Retry:  &RetryPolicy{MaxRetries: 1},
+	}, failing.URL, healthy.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("GET", "/", nil)
+	rec := httptest.NewRecorder()
+	lb.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Errorf("Want status %d after retry. Got %d.", http.StatusOK, rec.Code)
+	}
+}
+
+func TestLoadBalancerHedgedRequestClonesBodyPerAttempt(t *testing.T) {
+	const body = "hedge-body-payload"
+	var mu sync.Mutex
+	var secondaryBody string
+
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+		data, _ := io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusOK)
+		w.Write(data)
+	}))
+	defer slow.Close()
+
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		secondaryBody = string(data)
+		mu.Unlock()
+		w.WriteHeader(http.StatusOK)
+		w.Write(data)
+	}))
+	defer fast.Close()
+
+	retry := &RetryPolicy{Hedge: &HedgePolicy{Delay: 5 * time.Millisecond}}
+	lb, err := NewLoadBalancerWithOptions(LoadBalancerOptions{Retry: retry}, slow.URL, fast.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Bias selection so the hedge's secondary race (picked by LeastConnPolicy
+	// once the timer fires) lands on fast rather than re-selecting primary.
+	primary := lb.p.backends[0]
+	primary.load.increment()
+
+	req := httptest.NewRequest("PUT", "/", strings.NewReader(body))
+	bufferedBody, _ := bufferBody(req, retry)
+	buf := lb.hedgedAttempt(req, primary, retry.Hedge.Delay, bufferedBody)
+
+	if buf.code != http.StatusOK {
+		t.Fatalf("Want status %d. Got %d.", http.StatusOK, buf.code)
+	}
+	if buf.body.String() != body {
+		t.Errorf("Wrong response body from hedge winner. Want %q. Got %q.", body, buf.body.String())
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if secondaryBody != body {
+		t.Errorf("Secondary hedge race got wrong body (clone didn't get its own reader). Want %q. Got %q.", body, secondaryBody)
+	}
+}
+
+func TestLoadBalancerStreamingResponseBypassesBuffering(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+		flusher := w.(http.Flusher)
+		for i := 0; i < 3; i++ {
+			io.WriteString(w, "data: chunk\n\n")
+			flusher.Flush()
+		}
+	}))
+	defer server.Close()
+
+	lb, err := NewLoadBalancerWithOptions(LoadBalancerOptions{
+		Retry: &RetryPolicy{MaxRetries: 2},
+	}, server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("GET", "/", nil)
+	rec := httptest.NewRecorder()
+	lb.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Errorf("Want status %d. Got %d.", http.StatusOK, rec.Code)
+	}
+	want := strings.Repeat("data: chunk\n\n", 3)
+	if rec.Body.String() != want {
+		t.Errorf("Wrong streamed body. Want %q. Got %q.", want, rec.Body.String())
+	}
+}
+
+func TestLoadBalancerDoesNotRetryNonIdempotentByDefault(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	lb, err := NewLoadBalancerWithOptions(LoadBalancerOptions{
+		Retry: &RetryPolicy{MaxRetries: 3},
+	}, server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("POST", "/", nil)
+	rec := httptest.NewRecorder()
+	lb.ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadGateway {
+		t.Errorf("Want status %d for a non-retried POST. Got %d.", http.StatusBadGateway, rec.Code)
+	}
+}
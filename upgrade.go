@@ -0,0 +1,98 @@
+// Copyright 2013 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lb
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// isUpgrade reports whether r is an HTTP connection upgrade request (most
+// commonly WebSocket), which LoadBalancer serves through serveUpgrade as a
+// raw, bidirectionally-spliced connection instead of httputil.ReverseProxy.
+func isUpgrade(r *http.Request) bool {
+	return headerContainsToken(r.Header, "Connection", "upgrade") && r.Header.Get("Upgrade") != ""
+}
+
+func headerContainsToken(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, s := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(s), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// serveUpgrade hijacks the client connection, dials b directly, forwards
+// the original request line and headers, and splices the two connections
+// bidirectionally. b is only reported done, releasing its load, once both
+// halves have closed.
+func (lb *LoadBalancer) serveUpgrade(w http.ResponseWriter, r *http.Request, b *backend) {
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "connection upgrade not supported", http.StatusInternalServerError)
+		lb.done <- b
+		return
+	}
+	client, _, err := hj.Hijack()
+	if err != nil {
+		lb.done <- b
+		return
+	}
+	defer client.Close()
+
+	upstream, err := dialBackend(b)
+	if err != nil {
+		lb.done <- b
+		return
+	}
+	defer upstream.Close()
+
+	outreq := r.Clone(r.Context())
+	outreq.URL.Scheme = b.url.Scheme
+	outreq.URL.Host = b.url.Host
+	outreq.Host = b.url.Host
+	if err := outreq.Write(upstream); err != nil {
+		lb.done <- b
+		return
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go spliceHalf(&wg, upstream, client)
+	go spliceHalf(&wg, client, upstream)
+	wg.Wait()
+
+	lb.done <- b
+}
+
+func spliceHalf(wg *sync.WaitGroup, dst, src net.Conn) {
+	defer wg.Done()
+	io.Copy(dst, src)
+	if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	}
+}
+
+func dialBackend(b *backend) (net.Conn, error) {
+	addr := b.url.Host
+	if !strings.Contains(addr, ":") {
+		if b.url.Scheme == "https" {
+			addr += ":443"
+		} else {
+			addr += ":80"
+		}
+	}
+	if b.url.Scheme == "https" {
+		return tls.Dial("tcp", addr, &tls.Config{})
+	}
+	return net.Dial("tcp", addr)
+}
@@ -0,0 +1,117 @@
+// Copyright 2013 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lb
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestIsUpgrade(t *testing.T) {
+	tests := []struct {
+		connection, upgrade string
+		want                bool
+	}{
+		{"Upgrade", "websocket", true},
+		{"keep-alive, Upgrade", "websocket", true},
+		{"keep-alive", "", false},
+		{"keep-alive", "websocket", false},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		r, _ := http.NewRequest("GET", "/", nil)
+		if tt.connection != "" {
+			r.Header.Set("Connection", tt.connection)
+		}
+		if tt.upgrade != "" {
+			r.Header.Set("Upgrade", tt.upgrade)
+		}
+		if got := isUpgrade(r); got != tt.want {
+			t.Errorf("isUpgrade(Connection=%q, Upgrade=%q). Want %v. Got %v.", tt.connection, tt.upgrade, tt.want, got)
+		}
+	}
+}
+
+// echoUpgradeHandler hijacks the connection for any upgrade request and
+// echoes back whatever it reads, simulating a backend WebSocket endpoint.
+type echoUpgradeHandler struct{}
+
+func (echoUpgradeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "hijack not supported", http.StatusInternalServerError)
+		return
+	}
+	conn, _, err := hj.Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	conn.Write([]byte("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n"))
+	echoLoop(conn)
+}
+
+// echoLoop reads from conn and writes whatever it reads straight back.
+func echoLoop(conn net.Conn) {
+	buf := make([]byte, 1024)
+	for {
+		n, err := conn.Read(buf)
+		if n > 0 {
+			if _, werr := conn.Write(buf[:n]); werr != nil {
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func TestLoadBalancerServeHTTPUpgradeRealServer(t *testing.T) {
+	backend := httptest.NewServer(echoUpgradeHandler{})
+	defer backend.Close()
+	lb, err := NewLoadBalancer(backend.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frontend := httptest.NewServer(lb)
+	defer frontend.Close()
+
+	conn, err := net.Dial("tcp", frontend.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	req, _ := http.NewRequest("GET", frontend.URL+"/", nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	if err := req.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Wrong status. Want %d. Got %d.", http.StatusSwitchingProtocols, resp.StatusCode)
+	}
+
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	echoed := make([]byte, 4)
+	if _, err := br.Read(echoed); err != nil {
+		t.Fatal(err)
+	}
+	if string(echoed) != "ping" {
+		t.Errorf("Wrong echoed bytes. Want %q. Got %q.", "ping", string(echoed))
+	}
+}